@@ -0,0 +1,64 @@
+// Copyright 2014 The Gogs Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package conf
+
+import "time"
+
+// SSHConfig represents the `[ssh]` section of app.ini that configures the
+// built-in SSH server's host keys, rate limiting, and sandboxing.
+type SSHConfig struct {
+	// HostKeyPaths overrides the default per-algorithm host key locations
+	// under AppDataPath/ssh (one gogs.ed25519/gogs.ecdsa/gogs.rsa file each).
+	// One signer is loaded per path; missing files are generated in place.
+	// Leave empty to use the defaults.
+	HostKeyPaths []string `ini:"HOST_KEY_PATHS"`
+
+	// AuditLogPath is the rotating, JSON-lines audit log of SSH sessions
+	// (authenticated key, command, exit status, bytes transferred, ...).
+	// Leave empty to disable audit logging.
+	AuditLogPath string `ini:"AUDIT_LOG_PATH"`
+
+	// MaxHandshakes caps the number of SSH connections being handshaked or
+	// served at once. Defaults to 100 when unset or non-positive.
+	MaxHandshakes int `ini:"MAX_HANDSHAKES"`
+
+	// MaxSessionsPerKey caps the number of concurrent Git sessions a single
+	// public key may have open at once. Defaults to 4 when unset or
+	// non-positive.
+	MaxSessionsPerKey int `ini:"MAX_SESSIONS_PER_KEY"`
+
+	// PerUserRequestsPerMinute caps how many Git operations a single
+	// authenticated user may start per minute, across all of that user's
+	// keys. Defaults to 60 when unset or
+	// non-positive.
+	PerUserRequestsPerMinute int `ini:"PER_USER_REQUESTS_PER_MINUTE"`
+
+	// PerIPAuthFailuresPerMinute caps how many failed public-key attempts a
+	// single source IP may make per minute before it is temporarily banned.
+	// Defaults to 10 when unset or non-positive.
+	PerIPAuthFailuresPerMinute int `ini:"PER_IP_AUTH_FAILURES_PER_MINUTE"`
+
+	// PerIPBanDuration is how long an IP is banned after exceeding
+	// PerIPAuthFailuresPerMinute. Defaults to 15 minutes when unset or
+	// non-positive.
+	PerIPBanDuration time.Duration `ini:"PER_IP_BAN_DURATION"`
+
+	// SessionTimeout bounds the total lifetime of a single Git SSH session.
+	// Defaults to 2 hours when unset or non-positive.
+	SessionTimeout time.Duration `ini:"SESSION_TIMEOUT"`
+
+	// SessionIdleTimeout ends a session early if neither side has sent any
+	// data for this long. Defaults to 5 minutes when unset or non-positive.
+	SessionIdleTimeout time.Duration `ini:"SESSION_IDLE_TIMEOUT"`
+
+	// SandboxNamespaces enables Linux namespace isolation (mount, PID, net)
+	// for spawned `serv` child processes, in addition to the chdir and
+	// scrubbed environment applied unconditionally. Linux only; ignored
+	// elsewhere.
+	SandboxNamespaces bool `ini:"SANDBOX_NAMESPACES"`
+}
+
+// SSH is the parsed `[ssh]` section of app.ini.
+var SSH = SSHConfig{}
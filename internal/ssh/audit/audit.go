@@ -0,0 +1,97 @@
+// Copyright 2014 The Gogs Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+// Package audit records structured, per-session audit events for the
+// built-in SSH server so operators can feed them into compliance
+// dashboards, SIEMs, or alerting.
+package audit
+
+import (
+	"encoding/json"
+	"io"
+	"sync"
+	"time"
+
+	"gopkg.in/natefinch/lumberjack.v2"
+
+	"gogs.io/gogs/internal/conf"
+)
+
+// Event is the audit trail for a single SSH session, recorded once the
+// session ends.
+type Event struct {
+	Time          time.Time     `json:"time"`
+	RemoteAddr    string        `json:"remote_addr"`
+	ClientVersion string        `json:"client_version"`
+	UserID        int64         `json:"user_id,omitempty"`
+	KeyID         string        `json:"key_id"`
+	Fingerprint   string        `json:"fingerprint"`
+	Command       string        `json:"command"`
+	Verb          string        `json:"verb,omitempty"`
+	Repository    string        `json:"repository,omitempty"`
+	ExitStatus    int           `json:"exit_status"`
+	BytesIn       int64         `json:"bytes_in"`
+	BytesOut      int64         `json:"bytes_out"`
+	Duration      time.Duration `json:"duration_ns"`
+}
+
+// Sink receives every Event as it is recorded. This is scaffolding for
+// consumers that want session activity without the ssh package knowing
+// about them — e.g. a future DB-backed subscriber or outgoing webhooks —
+// but nothing in this package registers one yet; Subscribe currently has
+// no callers.
+type Sink interface {
+	Audit(Event)
+}
+
+var (
+	mu          sync.RWMutex
+	writer      io.WriteCloser
+	subscribers []Sink
+)
+
+// Init opens the rotating audit log file at conf.SSH.AuditLogPath. It is a
+// no-op if no path is configured.
+func Init() {
+	if conf.SSH.AuditLogPath == "" {
+		return
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	writer = &lumberjack.Logger{
+		Filename:   conf.SSH.AuditLogPath,
+		MaxSize:    100, // megabytes
+		MaxAge:     28,  // days
+		MaxBackups: 10,
+		Compress:   true,
+	}
+}
+
+// Subscribe registers a Sink to receive every Event recorded from this
+// point on, in addition to the rotating log file.
+func Subscribe(s Sink) {
+	mu.Lock()
+	defer mu.Unlock()
+	subscribers = append(subscribers, s)
+}
+
+// Record appends ev to the rotating log file as a single JSON line and
+// fans it out to every subscriber.
+func Record(ev Event) {
+	mu.RLock()
+	w := writer
+	subs := subscribers
+	mu.RUnlock()
+
+	if w != nil {
+		if data, err := json.Marshal(ev); err == nil {
+			_, _ = w.Write(append(data, '\n'))
+		}
+	}
+
+	for _, s := range subs {
+		s.Audit(ev)
+	}
+}
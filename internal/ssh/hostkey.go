@@ -0,0 +1,219 @@
+// Copyright 2014 The Gogs Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package ssh
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/unknwon/com"
+	gossh "golang.org/x/crypto/ssh"
+	log "unknwon.dev/clog/v2"
+
+	"gogs.io/gogs/internal/conf"
+)
+
+var (
+	hostKeysMu sync.RWMutex
+	hostKeys   []gossh.Signer
+)
+
+// currentHostKeys returns the host keys presented to clients right now. It
+// is safe to call concurrently with reloadHostKeys.
+func currentHostKeys() []gossh.Signer {
+	hostKeysMu.RLock()
+	defer hostKeysMu.RUnlock()
+	return hostKeys
+}
+
+// defaultHostKeyPaths is used when the operator hasn't configured
+// conf.SSH.HostKeyPaths: one key per supported algorithm, stored next to
+// where the old RSA-only key used to live.
+func defaultHostKeyPaths() []string {
+	dir := filepath.Join(conf.Server.AppDataPath, "ssh")
+	return []string{
+		filepath.Join(dir, "gogs.ed25519"),
+		filepath.Join(dir, "gogs.ecdsa"),
+		filepath.Join(dir, "gogs.rsa"),
+	}
+}
+
+// loadHostKeys loads every configured host key, generating and persisting
+// any that don't exist on disk yet.
+func loadHostKeys() ([]gossh.Signer, error) {
+	paths := conf.SSH.HostKeyPaths
+	if len(paths) == 0 {
+		paths = defaultHostKeyPaths()
+	}
+
+	signers := make([]gossh.Signer, 0, len(paths))
+	for _, path := range paths {
+		signer, err := loadOrGenerateHostKey(path)
+		if err != nil {
+			return nil, fmt.Errorf("load host key %q: %v", path, err)
+		}
+		log.Info("SSH: Loaded host key %s (%s %s)", path, signer.PublicKey().Type(), fingerprintSHA256(signer.PublicKey()))
+		signers = append(signers, signer)
+	}
+	return signers, nil
+}
+
+// reloadHostKeys re-reads every host key from disk, swapping them in
+// atomically. Existing sessions keep the key they handshook with; only new
+// connections see the reloaded set.
+func reloadHostKeys() {
+	signers, err := loadHostKeys()
+	if err != nil {
+		log.Error("SSH: Failed to reload host keys, keeping previous set: %v", err)
+		return
+	}
+
+	hostKeysMu.Lock()
+	hostKeys = signers
+	hostKeysMu.Unlock()
+	log.Info("SSH: Reloaded %d host key(s)", len(signers))
+}
+
+// watchHostKeyReload reloads host keys whenever the process receives
+// SIGHUP, so an operator can rotate keys without restarting Gogs.
+func watchHostKeyReload() {
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGHUP)
+	go func() {
+		for range sigCh {
+			reloadHostKeys()
+		}
+	}()
+}
+
+func loadOrGenerateHostKey(path string) (gossh.Signer, error) {
+	if com.IsExist(path) {
+		pemBytes, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		return gossh.ParsePrivateKey(pemBytes)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+		return nil, err
+	}
+
+	pemBytes, err := generateHostKeyPEM(hostKeyAlgoForPath(path))
+	if err != nil {
+		return nil, err
+	}
+	if err := ioutil.WriteFile(path, pemBytes, 0600); err != nil {
+		return nil, err
+	}
+	log.Trace("SSH: Generated new host key: %s", path)
+	return gossh.ParsePrivateKey(pemBytes)
+}
+
+// hostKeyAlgoForPath infers the key algorithm to generate from the file
+// extension of one of defaultHostKeyPaths, defaulting to RSA for anything
+// else (e.g. an operator-supplied path with no recognized suffix).
+func hostKeyAlgoForPath(path string) string {
+	switch filepath.Ext(path) {
+	case ".ed25519":
+		return "ed25519"
+	case ".ecdsa":
+		return "ecdsa"
+	default:
+		return "rsa"
+	}
+}
+
+func generateHostKeyPEM(algo string) ([]byte, error) {
+	var (
+		key interface{}
+		err error
+	)
+	switch algo {
+	case "ed25519":
+		_, key, err = ed25519.GenerateKey(rand.Reader)
+	case "ecdsa":
+		key, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	default:
+		key, err = rsa.GenerateKey(rand.Reader, 4096)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	block, err := gossh.MarshalPrivateKey(key, "")
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(block), nil
+}
+
+func fingerprintSHA256(key gossh.PublicKey) string {
+	sum := sha256.Sum256(key.Marshal())
+	return "SHA256:" + base64.RawStdEncoding.EncodeToString(sum[:])
+}
+
+// sshfpAlgorithm maps a host key type to the algorithm number used in DNS
+// SSHFP records (RFC 6594, RFC 7479).
+func sshfpAlgorithm(keyType string) (int, bool) {
+	switch {
+	case keyType == gossh.KeyAlgoRSA:
+		return 1, true
+	case keyType == gossh.KeyAlgoED25519:
+		return 4, true
+	case strings.HasPrefix(keyType, "ecdsa-"):
+		return 3, true
+	default:
+		return 0, false
+	}
+}
+
+// PrintHostKeys loads the server's configured host keys (generating any
+// that don't exist yet, exactly like Listen would) and writes them for the
+// given hostname in both known_hosts and DNS SSHFP record formats, so an
+// operator can publish them out-of-band. This backs the `sshs -print-host-keys`
+// flag and does not require the SSH server to be running.
+func PrintHostKeys(w io.Writer, host string) error {
+	signers, err := loadHostKeys()
+	if err != nil {
+		return err
+	}
+
+	for _, signer := range signers {
+		pub := signer.PublicKey()
+		if _, err := fmt.Fprintf(w, "%s %s %s\n", host, pub.Type(), base64.StdEncoding.EncodeToString(pub.Marshal())); err != nil {
+			return err
+		}
+	}
+
+	for _, signer := range signers {
+		pub := signer.PublicKey()
+		algo, ok := sshfpAlgorithm(pub.Type())
+		if !ok {
+			continue
+		}
+		sum := sha256.Sum256(pub.Marshal())
+		if _, err := fmt.Fprintf(w, "%s. IN SSHFP %d 2 %s\n", host, algo, strings.ToUpper(hex.EncodeToString(sum[:]))); err != nil {
+			return err
+		}
+	}
+	return nil
+}
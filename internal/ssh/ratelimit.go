@@ -0,0 +1,297 @@
+// Copyright 2014 The Gogs Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package ssh
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"golang.org/x/time/rate"
+	log "unknwon.dev/clog/v2"
+
+	"gogs.io/gogs/internal/conf"
+)
+
+// Metrics below are registered on the default Prometheus registerer and
+// served by the process' existing /metrics endpoint.
+var (
+	metricHandshakesInFlight = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: "gogs",
+		Subsystem: "ssh",
+		Name:      "handshakes_in_flight",
+		Help:      "Number of SSH connections currently being handshaked or served.",
+	})
+	metricHandshakesRejected = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "gogs",
+		Subsystem: "ssh",
+		Name:      "handshakes_rejected_total",
+		Help:      "Number of incoming SSH connections rejected before handshake, by reason.",
+	}, []string{"reason"})
+	metricAuthFailures = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: "gogs",
+		Subsystem: "ssh",
+		Name:      "auth_failures_total",
+		Help:      "Number of failed SSH public-key authentication attempts.",
+	})
+	metricSessionsActive = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: "gogs",
+		Subsystem: "ssh",
+		Name:      "sessions_active",
+		Help:      "Number of Git SSH sessions currently executing.",
+	})
+)
+
+func maxHandshakes() int {
+	if conf.SSH.MaxHandshakes > 0 {
+		return conf.SSH.MaxHandshakes
+	}
+	return 100
+}
+
+func maxSessionsPerKey() int {
+	if conf.SSH.MaxSessionsPerKey > 0 {
+		return conf.SSH.MaxSessionsPerKey
+	}
+	return 4
+}
+
+func perUserRequestsPerMinute() int {
+	if conf.SSH.PerUserRequestsPerMinute > 0 {
+		return conf.SSH.PerUserRequestsPerMinute
+	}
+	return 60
+}
+
+func perIPAuthFailuresPerMinute() int {
+	if conf.SSH.PerIPAuthFailuresPerMinute > 0 {
+		return conf.SSH.PerIPAuthFailuresPerMinute
+	}
+	return 10
+}
+
+func perIPBanDuration() time.Duration {
+	if conf.SSH.PerIPBanDuration > 0 {
+		return conf.SSH.PerIPBanDuration
+	}
+	return 15 * time.Minute
+}
+
+func sessionTimeout() time.Duration {
+	if conf.SSH.SessionTimeout > 0 {
+		return conf.SSH.SessionTimeout
+	}
+	return 2 * time.Hour
+}
+
+func sessionIdleTimeout() time.Duration {
+	if conf.SSH.SessionIdleTimeout > 0 {
+		return conf.SSH.SessionIdleTimeout
+	}
+	return 5 * time.Minute
+}
+
+// limiterEntryTTL is how long an IP or key can go unseen before its rate
+// limiter state is evicted. It bounds the memory a scanner hitting many
+// distinct IPs or key fingerprints can force us to hold onto.
+const limiterEntryTTL = 30 * time.Minute
+
+// limiterSweepInterval is how often stale limiter entries are evicted.
+const limiterSweepInterval = 5 * time.Minute
+
+// handshakeSem bounds the number of SSH connections being handshaked or
+// served concurrently, so a burst of connections can't exhaust file
+// descriptors or CPU. It is sized by initHandshakeLimiter, called once from
+// Listen.
+var handshakeSem chan struct{}
+
+func initHandshakeLimiter() {
+	handshakeSem = make(chan struct{}, maxHandshakes())
+	startLimiterSweeper()
+}
+
+// startLimiterSweeper periodically evicts rate limiter state that hasn't
+// been touched in limiterEntryTTL, so a scanner hitting us from many source
+// IPs or with many distinct bogus key fingerprints can't grow these maps
+// without bound.
+func startLimiterSweeper() {
+	go func() {
+		ticker := time.NewTicker(limiterSweepInterval)
+		defer ticker.Stop()
+		for range ticker.C {
+			authLimiter.sweep()
+			requestLimiter.sweep()
+		}
+	}()
+}
+
+// acquireHandshakeSlot reserves a slot in the bounded worker pool, or
+// returns false if the server is already at maxHandshakes.
+func acquireHandshakeSlot() bool {
+	select {
+	case handshakeSem <- struct{}{}:
+		metricHandshakesInFlight.Inc()
+		return true
+	default:
+		metricHandshakesRejected.WithLabelValues("max_handshakes").Inc()
+		return false
+	}
+}
+
+func releaseHandshakeSlot() {
+	<-handshakeSem
+	metricHandshakesInFlight.Dec()
+}
+
+// remoteIP strips the port from addr, falling back to its full string form
+// if it isn't a host:port pair.
+func remoteIP(addr net.Addr) string {
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host
+}
+
+// ipAuthLimiter token-bucket limits failed public-key auth attempts per
+// source IP and issues temporary bans once the bucket is exhausted.
+type ipAuthLimiter struct {
+	mu       sync.Mutex
+	limiters map[string]*rate.Limiter
+	bannedAt map[string]time.Time
+	lastSeen map[string]time.Time
+}
+
+var authLimiter = &ipAuthLimiter{
+	limiters: make(map[string]*rate.Limiter),
+	bannedAt: make(map[string]time.Time),
+	lastSeen: make(map[string]time.Time),
+}
+
+func (l *ipAuthLimiter) banned(ip string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	until, ok := l.bannedAt[ip]
+	if !ok {
+		return false
+	}
+	if time.Now().After(until) {
+		delete(l.bannedAt, ip)
+		return false
+	}
+	return true
+}
+
+// recordFailure accounts a failed auth attempt from ip, banning it for
+// perIPBanDuration once it exceeds perIPAuthFailuresPerMinute.
+func (l *ipAuthLimiter) recordFailure(ip string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	lim, ok := l.limiters[ip]
+	if !ok {
+		lim = rate.NewLimiter(rate.Limit(float64(perIPAuthFailuresPerMinute())/60), perIPAuthFailuresPerMinute())
+		l.limiters[ip] = lim
+	}
+	l.lastSeen[ip] = time.Now()
+	if !lim.Allow() {
+		l.bannedAt[ip] = time.Now().Add(perIPBanDuration())
+		log.Warn("SSH: Banning %s for %s after repeated auth failures", ip, perIPBanDuration())
+	}
+}
+
+// sweep evicts limiter state for IPs that haven't recorded a failure in
+// limiterEntryTTL and are no longer banned, so the maps don't grow without
+// bound under a distributed scan.
+func (l *ipAuthLimiter) sweep() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	cutoff := time.Now().Add(-limiterEntryTTL)
+	for ip, seen := range l.lastSeen {
+		if seen.After(cutoff) {
+			continue
+		}
+		if until, banned := l.bannedAt[ip]; banned && time.Now().Before(until) {
+			continue
+		}
+		delete(l.lastSeen, ip)
+		delete(l.limiters, ip)
+		delete(l.bannedAt, ip)
+	}
+}
+
+// keySessionLimiter caps the number of concurrent Git sessions a single
+// public key may have open at once.
+type keySessionLimiter struct {
+	mu     sync.Mutex
+	counts map[string]int
+}
+
+var keySessions = &keySessionLimiter{counts: make(map[string]int)}
+
+func (l *keySessionLimiter) acquire(keyID string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.counts[keyID] >= maxSessionsPerKey() {
+		return false
+	}
+	l.counts[keyID]++
+	return true
+}
+
+func (l *keySessionLimiter) release(keyID string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.counts[keyID]--
+	if l.counts[keyID] <= 0 {
+		delete(l.counts, keyID)
+	}
+}
+
+// userRequestLimiter enforces a requests-per-minute cap per authenticated
+// user, independent of the per-key concurrent-session cap above. It is
+// keyed by user ID rather than key ID so a user can't multiply their
+// budget by registering additional SSH keys.
+type userRequestLimiter struct {
+	mu       sync.Mutex
+	limiters map[int64]*rate.Limiter
+	lastSeen map[int64]time.Time
+}
+
+var requestLimiter = &userRequestLimiter{
+	limiters: make(map[int64]*rate.Limiter),
+	lastSeen: make(map[int64]time.Time),
+}
+
+func (l *userRequestLimiter) allow(userID int64) bool {
+	l.mu.Lock()
+	lim, ok := l.limiters[userID]
+	if !ok {
+		rpm := perUserRequestsPerMinute()
+		lim = rate.NewLimiter(rate.Limit(float64(rpm)/60), rpm)
+		l.limiters[userID] = lim
+	}
+	l.lastSeen[userID] = time.Now()
+	l.mu.Unlock()
+	return lim.Allow()
+}
+
+// sweep evicts limiter state for users who haven't made a request in
+// limiterEntryTTL, so a user who cycles through many accounts can't grow
+// this map without bound.
+func (l *userRequestLimiter) sweep() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	cutoff := time.Now().Add(-limiterEntryTTL)
+	for userID, seen := range l.lastSeen {
+		if seen.After(cutoff) {
+			continue
+		}
+		delete(l.lastSeen, userID)
+		delete(l.limiters, userID)
+	}
+}
@@ -0,0 +1,114 @@
+// Copyright 2014 The Gogs Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package ssh
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"gogs.io/gogs/internal/conf"
+)
+
+// applySandbox hardens cmd before it runs on behalf of an SSH client: chdir
+// into the target repository, drop to a scrubbed environment, and (where
+// platformSandbox supports it) isolate the process into fresh namespaces.
+//
+// This replaces the old syscall.Credential dance, which re-set the process'
+// own uid/gid right back to itself — a silent no-op that did nothing to
+// contain a compromised git hook.
+func applySandbox(cmd *exec.Cmd, repoPath string) {
+	cmd.Dir = filepath.Join(conf.Repository.Root, repoPath)
+	cmd.Env = scrubbedEnv(cmd.Env)
+	platformSandbox(cmd)
+}
+
+// scrubbedEnv keeps only the environment variables the `serv` subcommand and
+// Git itself need: PATH/HOME to find binaries, SSH_ORIGINAL_COMMAND for
+// `serv` to parse, GIT_PROTOCOL for protocol v2, and the GIT_LFS_* vars for
+// LFS transfers. Everything else the client or parent process set is
+// dropped.
+func scrubbedEnv(in []string) []string {
+	var out []string
+	for _, kv := range in {
+		name := kv
+		if i := strings.IndexByte(kv, '='); i >= 0 {
+			name = kv[:i]
+		}
+		switch {
+		case name == "PATH", name == "HOME", name == "SSH_ORIGINAL_COMMAND", name == "GIT_PROTOCOL":
+			out = append(out, kv)
+		case strings.HasPrefix(name, "GIT_LFS_"):
+			out = append(out, kv)
+		}
+	}
+
+	if !hasEnvKey(out, "PATH") {
+		out = append(out, "PATH="+os.Getenv("PATH"))
+	}
+	if !hasEnvKey(out, "HOME") {
+		out = append(out, "HOME="+os.Getenv("HOME"))
+	}
+	return out
+}
+
+func hasEnvKey(env []string, name string) bool {
+	prefix := name + "="
+	for _, kv := range env {
+		if strings.HasPrefix(kv, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// seccompHook, when non-nil, installs a syscall filter into the calling
+// process. It is only ever set (from sandbox_seccomp.go) when Gogs is built
+// with `-tags seccomp`.
+var seccompHook func() error
+
+// sandboxHelperEnv marks a re-exec'd child as the sandbox helper: install
+// the seccomp filter (if this build has one), then exec into the real Git
+// command. Set by platformSandbox, consumed by RunSandboxHelper.
+const sandboxHelperEnv = "GOGS_SSH_SANDBOX_HELPER"
+
+// RunSandboxHelper must be called by gogs' main entrypoint as its very
+// first action whenever sandboxHelperEnv is set, before any other package
+// is initialized, e.g.:
+//
+//	if os.Getenv("GOGS_SSH_SANDBOX_HELPER") == "1" {
+//		os.Exit(ssh.RunSandboxHelper(os.Args[1:]))
+//	}
+//
+// It installs the seccomp filter (a no-op unless built with `-tags
+// seccomp`) and then replaces itself with the target command via execve,
+// so the filter applies before the Git child ever runs.
+func RunSandboxHelper(args []string) int {
+	if seccompHook != nil {
+		if err := seccompHook(); err != nil {
+			return 1
+		}
+	}
+	if len(args) == 0 {
+		return 1
+	}
+	bin, err := exec.LookPath(args[0])
+	if err != nil {
+		return 1
+	}
+	// Drop the helper marker so the target, if it is this same binary, runs
+	// as itself rather than entering the helper branch again.
+	var env []string
+	for _, kv := range os.Environ() {
+		if !strings.HasPrefix(kv, sandboxHelperEnv+"=") {
+			env = append(env, kv)
+		}
+	}
+	if err := execve(bin, args, env); err != nil {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,49 @@
+// Copyright 2014 The Gogs Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+//go:build linux
+// +build linux
+
+package ssh
+
+import (
+	"os"
+	"os/exec"
+	"syscall"
+
+	"gogs.io/gogs/internal/conf"
+)
+
+// platformSandbox optionally isolates the Git child into fresh mount, PID,
+// and network namespaces, so a malicious pre-receive/post-receive hook
+// can't open outbound sockets or see host processes. The new mount
+// namespace starts as a copy of the host's mounts, so the host filesystem
+// stays visible. It is opt-in via conf.SSH.SandboxNamespaces; no user
+// namespace is created, so this needs CAP_SYS_ADMIN.
+//
+// When this binary was built with `-tags seccomp`, cmd is additionally
+// rewritten to re-exec itself as the sandbox helper first, so the seccomp
+// filter installs before the real Git command ever runs (see
+// RunSandboxHelper).
+func platformSandbox(cmd *exec.Cmd) {
+	if conf.SSH.SandboxNamespaces {
+		cmd.SysProcAttr = &syscall.SysProcAttr{
+			Cloneflags:   syscall.CLONE_NEWNS | syscall.CLONE_NEWPID | syscall.CLONE_NEWNET,
+			Unshareflags: syscall.CLONE_NEWNS,
+		}
+	}
+
+	if seccompHook != nil {
+		self, err := os.Executable()
+		if err == nil {
+			cmd.Args = append([]string{self}, cmd.Args...)
+			cmd.Path = self
+			cmd.Env = append(cmd.Env, sandboxHelperEnv+"=1")
+		}
+	}
+}
+
+func execve(bin string, args, env []string) error {
+	return syscall.Exec(bin, args, env)
+}
@@ -0,0 +1,33 @@
+// Copyright 2014 The Gogs Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+//go:build !linux
+// +build !linux
+
+package ssh
+
+import (
+	"os"
+	"os/exec"
+)
+
+// platformSandbox is a no-op outside Linux. The chdir and scrubbed Env
+// applySandbox already set up are the only hardening available there.
+func platformSandbox(cmd *exec.Cmd) {}
+
+// execve runs bin as a child and forwards its exit code, since not every
+// platform's syscall package exposes a true execve(2) the way Linux does.
+func execve(bin string, args, env []string) error {
+	cmd := exec.Command(bin, args[1:]...)
+	cmd.Env = env
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	if err := cmd.Run(); err != nil {
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			os.Exit(exitErr.ExitCode())
+		}
+		return err
+	}
+	os.Exit(0)
+	return nil
+}
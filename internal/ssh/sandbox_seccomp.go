@@ -0,0 +1,54 @@
+// Copyright 2014 The Gogs Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+//go:build linux && seccomp
+// +build linux,seccomp
+
+package ssh
+
+import (
+	libseccomp "github.com/seccomp/libseccomp-golang"
+	log "unknwon.dev/clog/v2"
+)
+
+// allowedSyscalls is the minimal set git-upload-pack and git-receive-pack
+// need to run. Anything else (networking, ptrace, module loading, ...) is
+// killed, which is what keeps a compromised pre-receive hook from phoning
+// home.
+var allowedSyscalls = []string{
+	"read", "write", "close", "fstat", "lstat", "stat", "openat", "open",
+	"mmap", "munmap", "mprotect", "brk", "rt_sigaction", "rt_sigprocmask",
+	"rt_sigreturn", "ioctl", "access", "execve", "exit", "exit_group", "wait4",
+	"clone", "fork", "vfork", "pipe", "pipe2", "dup", "dup2", "fcntl",
+	"getdents64", "readlink", "unlink", "rename", "mkdir", "rmdir",
+	"chdir", "getcwd", "chmod", "umask", "select", "poll", "pread64",
+	"pwrite64", "lseek", "getrandom", "set_tid_address", "set_robust_list",
+	"prlimit64", "sysinfo", "arch_prctl", "futex",
+}
+
+func init() {
+	seccompHook = installSeccompFilter
+}
+
+// installSeccompFilter loads a libseccomp allow-list into the calling
+// process. It must run after fork but before exec, so it is only ever
+// invoked from the re-exec'd helper (RunSandboxHelper), never from the
+// long-lived gogs process itself.
+func installSeccompFilter() error {
+	filter, err := libseccomp.NewFilter(libseccomp.ActKill)
+	if err != nil {
+		return err
+	}
+	for _, name := range allowedSyscalls {
+		call, err := libseccomp.GetSyscallFromName(name)
+		if err != nil {
+			log.Warn("SSH: sandbox: unknown syscall %q on this arch, skipping", name)
+			continue
+		}
+		if err := filter.AddRule(call, libseccomp.ActAllow); err != nil {
+			return err
+		}
+	}
+	return filter.Load()
+}
@@ -0,0 +1,79 @@
+// Copyright 2014 The Gogs Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package ssh
+
+import (
+	"os"
+	"os/exec"
+	"strings"
+	"testing"
+)
+
+func TestScrubbedEnv(t *testing.T) {
+	in := []string{
+		"PATH=/usr/bin",
+		"HOME=/home/git",
+		"SSH_ORIGINAL_COMMAND=git-upload-pack 'a/b.git'",
+		"GIT_PROTOCOL=version=2",
+		"GIT_LFS_SKIP_SMUDGE=1",
+		"LD_PRELOAD=/tmp/evil.so",
+		"SSH_AUTH_SOCK=/tmp/agent.sock",
+	}
+
+	out := scrubbedEnv(in)
+
+	for _, want := range []string{"PATH=/usr/bin", "HOME=/home/git", "SSH_ORIGINAL_COMMAND=git-upload-pack 'a/b.git'", "GIT_PROTOCOL=version=2", "GIT_LFS_SKIP_SMUDGE=1"} {
+		if !contains(out, want) {
+			t.Errorf("scrubbedEnv dropped %q, want it kept", want)
+		}
+	}
+	for _, unwanted := range []string{"LD_PRELOAD=/tmp/evil.so", "SSH_AUTH_SOCK=/tmp/agent.sock"} {
+		if contains(out, unwanted) {
+			t.Errorf("scrubbedEnv kept %q, a malicious hook could use this to escape its sandbox", unwanted)
+		}
+	}
+}
+
+func TestScrubbedEnvFillsMissingPathAndHome(t *testing.T) {
+	out := scrubbedEnv(nil)
+	if !hasEnvKey(out, "PATH") {
+		t.Error("scrubbedEnv(nil) has no PATH; the serv subcommand can't find git")
+	}
+	if !hasEnvKey(out, "HOME") {
+		t.Error("scrubbedEnv(nil) has no HOME; git can't find its config")
+	}
+}
+
+func contains(env []string, kv string) bool {
+	for _, v := range env {
+		if v == kv {
+			return true
+		}
+	}
+	return false
+}
+
+// TestRunSandboxHelper exercises the real re-exec path platformSandbox
+// rewrites a git command into: a subprocess (marked here by
+// GOGS_TEST_SANDBOX_HELPER_CHILD in place of GOGS_SSH_SANDBOX_HELPER) whose
+// only job is to call RunSandboxHelper and execve into the target. This is the exact mechanism that, left
+// unwired from gogs' entrypoint, broke every git-upload-pack/git-receive-pack
+// call under a `-tags seccomp` build.
+func TestRunSandboxHelper(t *testing.T) {
+	if os.Getenv("GOGS_TEST_SANDBOX_HELPER_CHILD") == "1" {
+		os.Exit(RunSandboxHelper([]string{"/bin/echo", "hello-from-sandbox-helper"}))
+	}
+
+	cmd := exec.Command(os.Args[0], "-test.run=TestRunSandboxHelper")
+	cmd.Env = append(os.Environ(), "GOGS_TEST_SANDBOX_HELPER_CHILD=1")
+	out, err := cmd.Output()
+	if err != nil {
+		t.Fatalf("sandbox helper subprocess failed: %v", err)
+	}
+
+	if got, want := strings.TrimSpace(string(out)), "hello-from-sandbox-helper"; got != want {
+		t.Errorf("RunSandboxHelper exec'd the wrong thing: got %q, want %q", got, want)
+	}
+}
@@ -5,267 +5,384 @@
 package ssh
 
 import (
+	"context"
 	"fmt"
 	"io"
-	"io/ioutil"
 	"net"
 	"os"
 	"os/exec"
-	"os/user"
-	"path/filepath"
-	"strconv"
+	"regexp"
 	"strings"
-	"syscall"
-	"unicode"
+	"time"
 
+	"github.com/anmitsu/go-shlex"
+	"github.com/gliderlabs/ssh"
 	"github.com/unknwon/com"
-	"golang.org/x/crypto/ssh"
+	gossh "golang.org/x/crypto/ssh"
 	log "unknwon.dev/clog/v2"
 
 	"gogs.io/gogs/internal/conf"
 	"gogs.io/gogs/internal/db"
+	"gogs.io/gogs/internal/ssh/audit"
 )
 
-func cleanCommand(cmd string) string {
-	i := strings.Index(cmd, "git")
-	if i == -1 {
-		return cmd
-	}
-	return cmd[i:]
+// ctxKeyID is the ssh.Context key under which the authenticated public
+// key's database ID is stored by publicKeyHandler.
+type ctxKeyID struct{}
+
+// ctxFingerprint is the ssh.Context key under which the authenticated
+// public key's SHA256 fingerprint is stored by publicKeyHandler.
+type ctxFingerprint struct{}
+
+// ctxUserID is the ssh.Context key under which the ID of the user who owns
+// the authenticated public key is stored by publicKeyHandler.
+type ctxUserID struct{}
+
+// allowedVerbs are the only Git SSH commands Gogs will ever execute on
+// behalf of a client. Everything else (shell builtins, arbitrary binaries,
+// `cat`, ...) is rejected before we touch the filesystem.
+var allowedVerbs = map[string]bool{
+	"git-upload-pack":      true,
+	"git-receive-pack":     true,
+	"git-upload-archive":   true,
+	"git-lfs-authenticate": true,
 }
 
-func handleServerConn(keyID string, chans <-chan ssh.NewChannel) {
-	for newChan := range chans {
-		if newChan.ChannelType() != "session" {
-			_ = newChan.Reject(ssh.UnknownChannelType, "unknown channel type")
-			continue
-		}
+// repoPathPattern matches the single `<owner>/<repo>.git` argument Git sends
+// after the verb. It does not accept quotes or a leading slash;
+// parseGitCommand strips those before matching.
+var repoPathPattern = regexp.MustCompile(`^[\w.\-]+/[\w.\-]+\.git$`)
 
-		ch, reqs, err := newChan.Accept()
-		if err != nil {
-			log.Error("Error accepting channel: %v", err)
-			continue
+// lfsDirections are the only valid third arguments to
+// `git-lfs-authenticate <repo> <direction>`.
+var lfsDirections = map[string]bool{
+	"upload":   true,
+	"download": true,
+}
+
+// parseGitCommand splits the client-supplied command line into a verb, a
+// repository path, and (for git-lfs-authenticate only) an upload/download
+// direction, rejecting anything that isn't an allow-listed Git operation
+// against a well-formed `<owner>/<repo>.git` path.
+func parseGitCommand(cmdName string) (verb, repoPath, lfsDirection string, ok bool) {
+	words, err := shlex.Split(cmdName, true)
+	if err != nil || len(words) < 2 || len(words) > 3 {
+		return "", "", "", false
+	}
+
+	verb = words[0]
+	if !allowedVerbs[verb] {
+		return "", "", "", false
+	}
+
+	if verb == "git-lfs-authenticate" {
+		if len(words) != 3 || !lfsDirections[words[2]] {
+			return "", "", "", false
 		}
+		lfsDirection = words[2]
+	} else if len(words) != 2 {
+		return "", "", "", false
+	}
 
-		go func(in <-chan *ssh.Request) {
-			defer func() {
-				_ = ch.Close()
-			}()
-			for req := range in {
-				payload := cleanCommand(string(req.Payload))
-				switch req.Type {
-				case "env":
-					var env struct {
-						Name  string
-						Value string
-					}
-					if err := ssh.Unmarshal(req.Payload, &env); err != nil {
-						log.Warn("SSH: Invalid env payload %q: %v", req.Payload, err)
-						continue
-					}
-					// Sometimes the client could send malformed command (i.e. missing "="),
-					// see https://discuss.gogs.io/t/ssh/3106.
-					if env.Name == "" || env.Value == "" {
-						log.Warn("SSH: Invalid env arguments: %+v", env)
-						continue
-					}
-
-					_, stderr, err := com.ExecCmd("env", fmt.Sprintf("%s=%s", env.Name, env.Value))
-					if err != nil {
-						log.Error("env: %v - %s", err, stderr)
-						return
-					}
-
-				case "exec":
-					cmdName := strings.TrimLeft(payload, "'()")
-					log.Info("SSH: Payload: %v", cmdName)
-
-					args := []string{"serv", "key-" + keyID, "--config=" + conf.CustomConf}
-					log.Info("SSH: Arguments: %v", args)
-					// cmd := exec.Command(conf.AppPath(), args...)
-
-					cmdPartsTemp := strings.Split(cmdName, " ")
-					var cmdParts []string
-					for i := range cmdParts {
-						cmdPartsTemp[i] = strings.TrimSpace(cmdPartsTemp[i])
-						cmdPartsTemp[i] = fmt.Sprint(cmdPartsTemp[i])
-						cmdPartsTemp[i] = strings.Map(func(r rune) rune {
-							if unicode.IsPrint(r) {
-								return r
-							}
-							return -1
-						}, cmdPartsTemp[i])
-						if len(cmdPartsTemp[i]) > 0 {
-							cmdParts = append(cmdParts, cmdPartsTemp[i])
-							log.Trace("SSH: arg[%d] length %d, %s", i, len(cmdParts[i]), cmdParts[i])
-						}
-					}
-
-					if cmdParts[0] == "cat" {
-						filePath := cmdParts[1]
-						f, err := os.OpenFile(filePath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
-						if err != nil {
-							log.Error("SSH: open error: %v", err)
-							return
-						}
-						_, _ = io.Copy(f, ch)
-						f.Close()
-					} else {
-						if len(cmdParts) > 0 {
-							cmdParts[0], err = exec.LookPath(cmdParts[0])
-							if err != nil {
-								log.Error("SSH: cannot find %d: %v", cmdParts[0], err)
-								return
-							}
-						}
-						var cmd *exec.Cmd
-						if len(cmdParts) > 1 {
-							cmd = exec.Command(cmdParts[0], cmdParts[1:]...)
-						} else if len(cmdParts) == 1 {
-							cmd = exec.Command(cmdParts[0])
-						} else {
-							return
-						}
-						// cmd.Env = append(os.Environ(), "SSH_ORIGINAL_COMMAND="+cmdName)
-
-						stdout, err := cmd.StdoutPipe()
-						if err != nil {
-							log.Error("SSH: StdoutPipe: %v", err)
-							return
-						}
-						stderr, err := cmd.StderrPipe()
-						if err != nil {
-							log.Error("SSH: StderrPipe: %v", err)
-							return
-						}
-						input, err := cmd.StdinPipe()
-						if err != nil {
-							log.Error("SSH: StdinPipe: %v", err)
-							return
-						}
-						u, err := user.Current()
-						if err != nil {
-							log.Error("SSH: ERROR: %v", err)
-							return
-						}
-						uid, err := strconv.Atoi(u.Uid)
-						if err != nil {
-							log.Error("SSH: ERROR: %v", err)
-							return
-						}
-						gid, err := strconv.Atoi(u.Gid)
-						if err != nil {
-							log.Error("SSH: ERROR: %v", err)
-							return
-						}
-						cmd.SysProcAttr = &syscall.SysProcAttr{}
-						cmd.SysProcAttr.Credential = &syscall.Credential{Uid: uint32(uid), Gid: uint32(gid)}
-
-						// FIXME: check timeout
-						log.Info("cmd: %s", cmd.String())
-						if err = cmd.Start(); err != nil {
-							log.Error("SSH: Start: %v", err)
-							return
-						}
-
-						_ = req.Reply(true, nil)
-						go func() {
-							_, _ = io.Copy(input, ch)
-						}()
-						_, _ = io.Copy(ch, stdout)
-						_, _ = io.Copy(ch.Stderr(), stderr)
-
-						if err = cmd.Wait(); err != nil {
-							log.Error("SSH: Wait: %v", err)
-							return
-						}
-					}
-
-					_, _ = ch.SendRequest("exit-status", false, []byte{0, 0, 0, 0})
-					return
-				default:
-				}
+	repoPath = strings.Trim(words[1], "'")
+	repoPath = strings.TrimPrefix(repoPath, "/")
+	if !repoPathPattern.MatchString(repoPath) {
+		return "", "", "", false
+	}
+
+	return verb, repoPath, lfsDirection, true
+}
+
+// handleSession is the ssh.Handler invoked for every authenticated session.
+// It covers both `exec` requests (git-upload-pack and friends) sent by Git
+// clients and plain interactive sessions opened via `pty-req`/`shell`.
+func handleSession(s ssh.Session) {
+	keyID, _ := s.Context().Value(ctxKeyID{}).(string)
+	userID, _ := s.Context().Value(ctxUserID{}).(int64)
+
+	args := s.Command()
+	if len(args) == 0 {
+		handleInteractiveSession(s)
+		return
+	}
+
+	if !requestLimiter.allow(userID) {
+		log.Warn("SSH: Rate limit exceeded for user-%d", userID)
+		_, _ = io.WriteString(s.Stderr(), "Gogs: rate limit exceeded, please slow down\n")
+		_ = s.Exit(1)
+		return
+	}
+
+	if !keySessions.acquire(keyID) {
+		log.Warn("SSH: Concurrent session limit exceeded for key-%s", keyID)
+		_, _ = io.WriteString(s.Stderr(), "Gogs: too many concurrent sessions for this key\n")
+		_ = s.Exit(1)
+		return
+	}
+	defer keySessions.release(keyID)
+
+	metricSessionsActive.Inc()
+	defer metricSessionsActive.Dec()
+
+	_ = s.Exit(execGitCommand(s, keyID, userID, strings.Join(args, " ")))
+}
+
+// handleInteractiveSession greets the authenticated user and exits, since
+// Gogs only serves Git traffic over SSH and does not provide shell access.
+func handleInteractiveSession(s ssh.Session) {
+	if _, winCh, isPty := s.Pty(); isPty {
+		// Nothing we run needs the terminal size, but the channel must be
+		// drained or the client blocks waiting for window-change acks.
+		go func() {
+			for range winCh {
 			}
-		}(reqs)
+		}()
 	}
+
+	_, _ = io.WriteString(s, fmt.Sprintf("Hi there! You've successfully authenticated with key fingerprint %s, but Gogs does not provide shell access.\n", sessionFingerprint(s)))
+	_ = s.Exit(0)
 }
 
-func listen(config *ssh.ServerConfig, host string, port int) {
-	listener, err := net.Listen("tcp", host+":"+com.ToStr(port))
+// execGitCommand validates the requested command against the Git SSH
+// allow-list, dispatches it to the `serv` subcommand, and returns the
+// process exit status. A audit.Event describing the whole session is
+// recorded before returning, regardless of outcome.
+func execGitCommand(s ssh.Session, keyID string, userID int64, cmdName string) int {
+	start := time.Now()
+	ev := audit.Event{
+		Time:          start,
+		RemoteAddr:    s.RemoteAddr().String(),
+		ClientVersion: s.Context().ClientVersion(),
+		UserID:        userID,
+		KeyID:         keyID,
+		Fingerprint:   sessionFingerprint(s),
+		Command:       cmdName,
+	}
+	defer func() {
+		ev.Duration = time.Since(start)
+		audit.Record(ev)
+	}()
+
+	verb, repoPath, lfsDirection, ok := parseGitCommand(cmdName)
+	if !ok {
+		log.Warn("SSH: Rejected disallowed command: %q", cmdName)
+		_, _ = io.WriteString(s.Stderr(), fmt.Sprintf("Gogs: unsupported command: %q\n", cmdName))
+		ev.ExitStatus = 1
+		return 1
+	}
+	ev.Verb = verb
+	ev.Repository = repoPath
+	log.Info("SSH: %s %s", verb, repoPath)
+
+	bin, err := exec.LookPath(conf.AppPath())
 	if err != nil {
-		log.Fatal("Failed to start SSH server: %v", err)
+		log.Error("SSH: cannot find %s: %v", conf.AppPath(), err)
+		ev.ExitStatus = 1
+		return 1
 	}
-	for {
-		// Once a ServerConfig has been configured, connections can be accepted.
-		conn, err := listener.Accept()
-		if err != nil {
-			log.Error("SSH: Error accepting incoming connection: %v", err)
-			continue
+
+	// ctx bounds the total lifetime of the session; idle additionally kills
+	// it early if neither side has sent any data for sessionIdleTimeout.
+	ctx, cancel := context.WithTimeout(s.Context(), sessionTimeout())
+	defer cancel()
+	idle := time.AfterFunc(sessionIdleTimeout(), cancel)
+	defer idle.Stop()
+	touch := func() { idle.Reset(sessionIdleTimeout()) }
+
+	originalCommand := verb + " '" + repoPath + "'"
+	if lfsDirection != "" {
+		originalCommand += " " + lfsDirection
+	}
+
+	cmd := exec.CommandContext(ctx, bin, "serv", "key-"+keyID, "--config="+conf.CustomConf)
+	cmd.Env = append(buildSessionEnv(s), "SSH_ORIGINAL_COMMAND="+originalCommand)
+	applySandbox(cmd, repoPath)
+
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		log.Error("SSH: StdoutPipe: %v", err)
+		ev.ExitStatus = 1
+		return 1
+	}
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		log.Error("SSH: StderrPipe: %v", err)
+		ev.ExitStatus = 1
+		return 1
+	}
+	input, err := cmd.StdinPipe()
+	if err != nil {
+		log.Error("SSH: StdinPipe: %v", err)
+		ev.ExitStatus = 1
+		return 1
+	}
+
+	log.Info("cmd: %s", cmd.String())
+	if err = cmd.Start(); err != nil {
+		log.Error("SSH: Start: %v", err)
+		ev.ExitStatus = 1
+		return 1
+	}
+
+	bytesInCh := make(chan int64, 1)
+	go func() {
+		n, _ := copyWithActivity(input, s, touch)
+		bytesInCh <- n
+	}()
+	ev.BytesOut, _ = copyWithActivity(s, stdout, touch)
+	_, _ = io.Copy(s.Stderr(), stderr)
+
+	exitStatus := 0
+	if err = cmd.Wait(); err != nil {
+		if ctx.Err() != nil {
+			log.Warn("SSH: Session for key-%s timed out: %v", keyID, ctx.Err())
+		} else {
+			log.Error("SSH: Wait: %v", err)
 		}
+		exitStatus = 1
+	}
 
-		// Before use, a handshake must be performed on the incoming net.Conn.
-		// It must be handled in a separate goroutine,
-		// otherwise one user could easily block entire loop.
-		// For example, user could be asked to trust server key fingerprint and hangs.
-		go func() {
-			log.Trace("SSH: Handshaking for %s", conn.RemoteAddr())
-			sConn, chans, reqs, err := ssh.NewServerConn(conn, config)
-			if err != nil {
-				if err == io.EOF {
-					log.Warn("SSH: Handshaking was terminated: %v", err)
-				} else {
-					log.Error("SSH: Error on handshaking: %v", err)
-				}
-				return
-			}
+	if ctx.Err() != nil {
+		// s.Context() is the per-connection context gliderlabs/ssh creates
+		// once in HandleConn, not a per-session one, so canceling ctx above
+		// stopped the child but left the stdin-copy goroutine started above parked
+		// in a read on s if the client went idle rather than disconnecting.
+		// Closing the session unblocks that read so the goroutine can exit.
+		_ = s.Close()
+	}
 
-			log.Trace("SSH: Connection from %s (%s)", sConn.RemoteAddr(), sConn.ClientVersion())
-			// The incoming Request channel must be serviced.
-			go ssh.DiscardRequests(reqs)
-			go handleServerConn(sConn.Permissions.Extensions["key-id"], chans)
-		}()
+	// The stdin-copy goroutine returns once it observes EOF or an error
+	// reading from s or writing to the child's stdin; cap how long we wait
+	// for it so a client we failed to unblock above can't wedge this
+	// goroutine, and the session slot it holds, forever.
+	select {
+	case ev.BytesIn = <-bytesInCh:
+	case <-time.After(5 * time.Second):
+		log.Warn("SSH: Timed out waiting for stdin copy to finish for key-%s", keyID)
 	}
+	ev.ExitStatus = exitStatus
+	return exitStatus
 }
 
-// Listen starts a SSH server listens on given port.
-func Listen(host string, port int, ciphers, macs []string) {
-	config := &ssh.ServerConfig{
-		Config: ssh.Config{
-			Ciphers: ciphers,
-			MACs:    macs,
-		},
-		PublicKeyCallback: func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
-			pkey, err := db.SearchPublicKeyByContent(strings.TrimSpace(string(ssh.MarshalAuthorizedKey(key))))
-			if err != nil {
-				log.Error("SearchPublicKeyByContent: %v", err)
-				return nil, err
+// sessionFingerprint returns the SHA256 fingerprint of the public key the
+// client authenticated with, as recorded by publicKeyHandler.
+func sessionFingerprint(s ssh.Session) string {
+	fingerprint, _ := s.Context().Value(ctxFingerprint{}).(string)
+	return fingerprint
+}
+
+// copyWithActivity is io.Copy, except touch is called after every chunk
+// successfully read from src so the caller can reset an idle timeout.
+func copyWithActivity(dst io.Writer, src io.Reader, touch func()) (int64, error) {
+	buf := make([]byte, 32*1024)
+	var written int64
+	for {
+		n, rerr := src.Read(buf)
+		if n > 0 {
+			touch()
+			wn, werr := dst.Write(buf[:n])
+			written += int64(wn)
+			if werr != nil {
+				return written, werr
 			}
-			return &ssh.Permissions{Extensions: map[string]string{"key-id": com.ToStr(pkey.ID)}}, nil
-		},
+		}
+		if rerr != nil {
+			if rerr == io.EOF {
+				return written, nil
+			}
+			return written, rerr
+		}
 	}
+}
 
-	keyPath := filepath.Join(conf.Server.AppDataPath, "ssh", fmt.Sprintf("gogs_%d.rsa", port))
-	if !com.IsExist(keyPath) {
-		if err := os.MkdirAll(filepath.Dir(keyPath), os.ModePerm); err != nil {
-			panic(err)
-		}
-		path, _ := exec.LookPath("ssh-keygen")
-		_, stderr, err := com.ExecCmd(path, "-f", keyPath, "-t", "rsa", "-m", "PEM", "-N", "")
-		if err != nil {
-			panic(fmt.Sprintf("Failed to generate private key: %v - %s", err, stderr))
+// buildSessionEnv forwards the client's `env` requests into the child
+// process environment.
+func buildSessionEnv(s ssh.Session) []string {
+	env := os.Environ()
+	for _, kv := range s.Environ() {
+		parts := strings.SplitN(kv, "=", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			// Sometimes the client could send malformed command (i.e. missing "="),
+			// see https://discuss.gogs.io/t/ssh/3106.
+			log.Warn("SSH: Invalid env arguments: %q", kv)
+			continue
 		}
-		log.Trace("SSH: New private key is generateed: %s", keyPath)
+		env = append(env, kv)
 	}
+	return env
+}
 
-	privateBytes, err := ioutil.ReadFile(keyPath)
+func publicKeyHandler(ctx ssh.Context, key ssh.PublicKey) bool {
+	ip := remoteIP(ctx.RemoteAddr())
+	if authLimiter.banned(ip) {
+		return false
+	}
+
+	pkey, err := db.SearchPublicKeyByContent(strings.TrimSpace(string(gossh.MarshalAuthorizedKey(key))))
 	if err != nil {
-		panic("SSH: Failed to load private key: " + err.Error())
+		log.Error("SearchPublicKeyByContent: %v", err)
+		metricAuthFailures.Inc()
+		authLimiter.recordFailure(ip)
+		return false
 	}
-	private, err := ssh.ParsePrivateKey(privateBytes)
+	ctx.SetValue(ctxKeyID{}, com.ToStr(pkey.ID))
+	ctx.SetValue(ctxFingerprint{}, fingerprintSHA256(key))
+	ctx.SetValue(ctxUserID{}, pkey.OwnerID)
+	return true
+}
+
+// Listen starts a SSH server listens on given port.
+func Listen(host string, port int, ciphers, macs []string) {
+	audit.Init()
+	initHandshakeLimiter()
+
+	signers, err := loadHostKeys()
 	if err != nil {
-		panic("SSH: Failed to parse private key: " + err.Error())
+		panic("SSH: Failed to load host keys: " + err.Error())
 	}
-	config.AddHostKey(private)
+	hostKeysMu.Lock()
+	hostKeys = signers
+	hostKeysMu.Unlock()
+	watchHostKeyReload()
 
-	go listen(config, host, port)
+	server := &ssh.Server{
+		Addr:             fmt.Sprintf("%s:%d", host, port),
+		Handler:          handleSession,
+		PublicKeyHandler: publicKeyHandler,
+		ConnCallback: func(ctx ssh.Context, conn net.Conn) net.Conn {
+			ip := remoteIP(conn.RemoteAddr())
+			if authLimiter.banned(ip) {
+				metricHandshakesRejected.WithLabelValues("banned_ip").Inc()
+				_ = conn.Close()
+				return nil
+			}
+			if !acquireHandshakeSlot() {
+				_ = conn.Close()
+				return nil
+			}
+			go func() {
+				<-ctx.Done()
+				releaseHandshakeSlot()
+			}()
+			return conn
+		},
+		ServerConfigCallback: func(ssh.Context) *gossh.ServerConfig {
+			config := &gossh.ServerConfig{
+				Config: gossh.Config{
+					Ciphers: ciphers,
+					MACs:    macs,
+				},
+			}
+			for _, signer := range currentHostKeys() {
+				config.AddHostKey(signer)
+			}
+			return config
+		},
+	}
+
+	go func() {
+		if err := server.ListenAndServe(); err != nil {
+			log.Fatal("Failed to start SSH server: %v", err)
+		}
+	}()
 }
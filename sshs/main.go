@@ -2,16 +2,34 @@ package main
 
 import (
 	"flag"
+	"os"
 	"time"
 
 	"gogs.io/gogs/internal/ssh"
 )
 
 func main() {
+	// Must run before anything else touches flags, config, or logging: the
+	// sandbox re-exec's itself with a bin path as argv[0], and any other
+	// startup work here would run twice (once as the helper, once as the
+	// real `serv` invocation it execve's into).
+	if os.Getenv("GOGS_SSH_SANDBOX_HELPER") == "1" {
+		os.Exit(ssh.RunSandboxHelper(os.Args[1:]))
+	}
+
 	var port *int
 	port = flag.Int("p", 9393, "ssh server port")
+	printHostKeys := flag.Bool("print-host-keys", false, "print host keys in known_hosts and SSHFP record formats and exit")
+	hostname := flag.String("hostname", "", "hostname to use when printing host keys with -print-host-keys")
 	flag.Parse()
 
+	if *printHostKeys {
+		if err := ssh.PrintHostKeys(os.Stdout, *hostname); err != nil {
+			os.Exit(1)
+		}
+		return
+	}
+
 	ssh.Listen(
 		"0.0.0.0",
 		*port,